@@ -0,0 +1,40 @@
+// Copyright (c) 2023, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package responsefile
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Exec prepares name to be run with args, automatically using a response
+// file via [Shorten] if the total length of args exceeds a fixed
+// per-platform estimate of the limit on the size of a child process's
+// argument list: 128KiB on Unix-like systems and 32KiB elsewhere.
+// The platform's actual limit is not queried at run time.
+//
+// opts.ArgLengthLimit, if set, further caps the threshold at which a
+// response file is used; the smaller of it and the platform's own limit is
+// used. A negative opts.ArgLengthLimit, as with [Shorten], produces a
+// response file whenever the total length of args is not zero.
+//
+// If no error is reported, a cleanup func is returned, which must be called
+// once the returned [exec.Cmd] has finished, to avoid leaving temporary
+// files behind. The returned command is not started.
+func Exec(ctx context.Context, name string, args []string, opts ShortenOptions) (*exec.Cmd, func(), error) {
+	limit := platformArgMax
+	if opts.ArgLengthLimit < 0 {
+		limit = opts.ArgLengthLimit
+	} else if opts.ArgLengthLimit != 0 && opts.ArgLengthLimit < limit {
+		limit = opts.ArgLengthLimit
+	}
+	opts.ArgLengthLimit = limit
+
+	shortArgs, cleanup, err := Shorten(args, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.CommandContext(ctx, name, shortArgs...)
+	return cmd, cleanup, nil
+}
@@ -0,0 +1,10 @@
+// Copyright (c) 2023, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build !unix && !windows
+
+package responsefile
+
+// platformArgMax is a conservative fallback for platforms which are
+// neither Unix-like nor Windows, such as plan9 or js/wasm.
+const platformArgMax = 32 << 10 // 32KiB
@@ -0,0 +1,19 @@
+// Copyright (c) 2023, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build unix
+
+package responsefile
+
+// platformArgMax is a conservative estimate of the argv length limit on
+// Unix-like systems. The real ARG_MAX reported by sysconf(_SC_ARG_MAX) is
+// typically much larger, often a megabyte or more, but it varies by OS and
+// kernel configuration, and querying it would differ per OS: golang.org/x/sys/unix
+// only wraps it directly on Solaris, and would need RLIMIT_STACK arithmetic
+// on Linux or a sysctl on the BSDs and Darwin.
+//
+// We choose a conservative constant to avoid an extra dependency and the
+// per-OS logic required to query it properly. This may cause Exec to use a
+// response file a bit more eagerly than strictly necessary, which we accept
+// as a trade-off against an "argument list too long" error.
+const platformArgMax = 128 << 10 // 128KiB
@@ -0,0 +1,10 @@
+// Copyright (c) 2023, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+//go:build windows
+
+package responsefile
+
+// platformArgMax is the documented limit on the size of a Windows command
+// line, which applies to the entire argv rather than to each argument.
+const platformArgMax = 32 << 10 // 32KiB
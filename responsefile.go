@@ -17,22 +17,53 @@
 // Nested response files are also supported, although not all programs support
 // reading them.
 //
+// A number of tools use dialects of the response file format which differ
+// from the one described above; see [Dialect] for the ones we support.
+//
 // Useful links:
 // * https://gcc.gnu.org/wiki/Response_Files
 // * https://learn.microsoft.com/en-us/windows/win32/midl/response-files
 // * https://www.intel.com/content/www/us/en/docs/dpcpp-cpp-compiler/developer-guide-reference/2023-0/use-response-files.html
-//
-// TODO: some implementations support quoting.
-// TODO: some implementations support '#' comments.
 package responsefile
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"unicode/utf8"
 )
 
+// Dialect selects the response file format to use, as the format is not
+// formally specified and differs slightly between tools.
+type Dialect int
+
+const (
+	// DialectDefault is the format described in the package documentation:
+	// one argument per line, with backslash escaping newlines and backslashes.
+	DialectDefault Dialect = iota
+
+	// DialectGCC matches the format used by GCC and clang.
+	// Arguments are separated by any whitespace, not just newlines.
+	// Double-quoted strings may be used to include whitespace in an argument,
+	// and within them, `\"` and `\\` are the only recognized escapes.
+	// A `#` starting a new argument begins a comment which runs to the
+	// end of the line.
+	DialectGCC
+
+	// DialectMSVC matches the format used by MSVC's link.exe and similar
+	// Windows toolchains. Arguments are separated by any whitespace, and
+	// double-quoted strings may be used to include whitespace in an
+	// argument. Within a quoted string, a backslash only escapes a quote
+	// or another backslash, and `""` is an alternative way to write a
+	// literal quote without ending the string.
+	DialectMSVC
+)
+
 // ShortenOptions holds parameters for [Shorten].
 type ShortenOptions struct {
 	// ArgLengthLimit is the number of bytes which can be passed directly
@@ -42,15 +73,48 @@ type ShortenOptions struct {
 	//
 	// A negative value can be used to always create response files.
 	ArgLengthLimit int
+
+	// Dialect selects the response file format to write.
+	// The zero value is [DialectDefault].
+	Dialect Dialect
+
+	// Dir is the directory in which response files are created,
+	// as passed to CreateFile.
+	// The zero value uses the default directory for temporary files,
+	// as in [os.CreateTemp].
+	Dir string
+
+	// CreateFile creates a new response file, returning a writer to it,
+	// the path to use for the "@path" argument, and any error.
+	// The zero value uses [os.CreateTemp], which is suitable for most
+	// callers; CreateFile exists for those which need to place response
+	// files somewhere other than the real filesystem, such as a sandbox's
+	// declared outputs or an in-memory filesystem in tests.
+	// The cleanup func returned by [Shorten] removes the returned path
+	// with [os.Remove], whichever CreateFile was used.
+	CreateFile func(dir, pattern string) (io.WriteCloser, string, error)
 }
 
 func (opts ShortenOptions) applyDefaults() ShortenOptions {
 	if opts.ArgLengthLimit == 0 {
 		opts.ArgLengthLimit = 30 << 10 // 30KiB, since Windows can limit at 32KiB
 	}
+	if opts.CreateFile == nil {
+		opts.CreateFile = createTempFile
+	}
 	return opts
 }
 
+// createTempFile is the default [ShortenOptions.CreateFile],
+// backed by [os.CreateTemp].
+func createTempFile(dir, pattern string) (io.WriteCloser, string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, f.Name(), nil
+}
+
 // Shorten produces an argument list which may use response files
 // if args is too long.
 //
@@ -74,17 +138,17 @@ func Shorten(args []string, opts ShortenOptions) (_ []string, cleanup func(), _
 	// We will need space for at least each argument plus a newline.
 	buf := make([]byte, 0, argLen+len(args))
 	for _, arg := range args {
-		buf = appendEncodedArg(buf, arg)
+		buf = appendEncodedArg(buf, arg, opts.Dialect)
 		buf = append(buf, '\n')
 	}
 
-	f, err := os.CreateTemp("", "responsefile")
+	f, path, err := opts.CreateFile(opts.Dir, "responsefile")
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot create response file: %w", err)
 	}
 	// In the rare case where we were able to create a temporary file but we
 	// cannot remove it, there's not much that can be done about it.
-	cleanup = func() { os.Remove(f.Name()) }
+	cleanup = func() { os.Remove(path) }
 
 	if _, err := f.Write(buf); err != nil {
 		f.Close()
@@ -95,13 +159,23 @@ func Shorten(args []string, opts ShortenOptions) (_ []string, cleanup func(), _
 		cleanup()
 		return nil, nil, fmt.Errorf("cannot close response file: %w", err)
 	}
-	args = []string{"@" + f.Name()}
+	args = []string{"@" + path}
 	return args, cleanup, nil
 }
 
-// appendEncodedArg appends arg to buf while escaping backslashes and
-// newlines.
-func appendEncodedArg(buf []byte, arg string) []byte {
+// appendEncodedArg appends arg to buf, escaping it as necessary for dialect.
+func appendEncodedArg(buf []byte, arg string, dialect Dialect) []byte {
+	switch dialect {
+	case DialectGCC, DialectMSVC:
+		return appendEncodedArgQuoted(buf, arg, dialect)
+	default:
+		return appendEncodedArgDefault(buf, arg)
+	}
+}
+
+// appendEncodedArgDefault appends arg to buf while escaping backslashes and
+// newlines, as used by [DialectDefault].
+func appendEncodedArgDefault(buf []byte, arg string) []byte {
 	if !strings.ContainsAny(arg, "\\\n") {
 		return append(buf, arg...) // shortcut
 	}
@@ -118,10 +192,72 @@ func appendEncodedArg(buf []byte, arg string) []byte {
 	return buf
 }
 
-// ExpandOptions holds parameters for [Expand].
+// appendEncodedArgQuoted appends arg to buf, quoting it if it contains
+// whitespace or characters with special meaning, as used by [DialectGCC]
+// and [DialectMSVC].
+func appendEncodedArgQuoted(buf []byte, arg string, dialect Dialect) []byte {
+	if !needsQuoting(arg, dialect) {
+		return append(buf, arg...) // shortcut
+	}
+	buf = append(buf, '"')
+	for _, r := range arg {
+		switch r {
+		case '"':
+			buf = append(buf, '\\', '"')
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		default:
+			buf = utf8.AppendRune(buf, r)
+		}
+	}
+	buf = append(buf, '"')
+	return buf
+}
+
+// needsQuoting reports whether arg must be surrounded by quotes to be
+// correctly parsed back as a single argument under dialect, which must be
+// [DialectGCC] or [DialectMSVC].
+func needsQuoting(arg string, dialect Dialect) bool {
+	if arg == "" {
+		return true
+	}
+	// Only GCC treats a leading `#` as starting a comment; MSVC has no
+	// such rule, so a leading `#` there needs no quoting.
+	if dialect == DialectGCC && strings.HasPrefix(arg, "#") {
+		return true
+	}
+	return strings.ContainsAny(arg, " \t\n\r\f\v\"")
+}
+
+// defaultMaxDepth is the default value of [ExpandOptions.MaxDepth].
+const defaultMaxDepth = 32
+
+// ExpandOptions holds parameters for [Expand] and [NewExpander].
 type ExpandOptions struct {
-	// Empty for now; we will likely need parameters in the future.
-	// For example, it might be nice to support io/fs.
+	// Dialect selects the response file format to parse.
+	// The zero value is [DialectDefault].
+	Dialect Dialect
+
+	// FS optionally overrides the filesystem used to read response files,
+	// which are opened via its Open method. This is useful when response
+	// files are served from a sandbox overlay or an in-memory filesystem
+	// such as [testing/fstest.MapFS].
+	//
+	// The zero value reads directly from the host filesystem via
+	// [os.Open].
+	FS fs.FS
+
+	// MaxDepth is the maximum number of nested response files allowed.
+	// The zero value implies a default of 32, which should be generous
+	// enough for any legitimate use of nested response files.
+	MaxDepth int
+}
+
+func (opts ExpandOptions) applyDefaults() ExpandOptions {
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = defaultMaxDepth
+	}
+	return opts
 }
 
 // Expand produces an argument list with any response files
@@ -130,57 +266,217 @@ type ExpandOptions struct {
 // The args slice may be returned directly if no response files were found;
 // otherwise, a new slice is returned.
 func Expand(args []string, opts ExpandOptions) ([]string, error) {
-	var expanded []string
-	for i, s := range args {
-		path, ok := strings.CutPrefix(s, "@")
+	hasResponseFile := false
+	for _, s := range args {
+		if strings.HasPrefix(s, "@") {
+			hasResponseFile = true
+			break
+		}
+	}
+	if !hasResponseFile {
+		return args, nil
+	}
+
+	expanded := make([]string, 0, len(args)*2)
+	exp := NewExpander(args, opts)
+	for {
+		arg, err := exp.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, arg)
+	}
+	return expanded, nil
+}
+
+// Expander produces the arguments of an expansion one at a time,
+// reading and tokenizing each nested response file incrementally as it is
+// read. Unlike [Expand], it never materializes the full expanded argument
+// list, nor the contents of any response file, which keeps peak memory use
+// independent of file size — useful for very large response files such as
+// those produced by linkers.
+type Expander struct {
+	opts   ExpandOptions
+	frames []expanderFrame
+}
+
+// expanderFrame holds the remaining arguments of one response file,
+// or of the top-level args passed to [NewExpander].
+// path is empty for the top-level frame.
+//
+// The top-level frame draws its arguments from args directly, since those
+// are already held in memory by the caller. Every other frame reads args
+// one at a time from tok, which streams them out of closer as it goes.
+type expanderFrame struct {
+	args []string
+	pos  int
+	path string
+
+	tok    *fileTokenizer
+	closer io.Closer
+}
+
+// next returns the frame's next raw argument, ok=false once the frame is
+// exhausted, or an error if a nested response file could not be read.
+func (f *expanderFrame) next() (arg string, ok bool, err error) {
+	if f.tok == nil {
+		if f.pos >= len(f.args) {
+			return "", false, nil
+		}
+		arg := f.args[f.pos]
+		f.pos++
+		return arg, true, nil
+	}
+	arg, err = f.tok.next()
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("responsefile: %s: %w", f.path, err)
+	}
+	return arg, true, nil
+}
+
+// close releases the frame's underlying response file, if any.
+func (f *expanderFrame) close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// NewExpander creates an [Expander] over args.
+func NewExpander(args []string, opts ExpandOptions) *Expander {
+	return &Expander{
+		opts:   opts.applyDefaults(),
+		frames: []expanderFrame{{args: args}},
+	}
+}
+
+// Next returns the next expanded argument, or [io.EOF]
+// once there are no arguments left.
+func (e *Expander) Next() (string, error) {
+	for len(e.frames) > 0 {
+		top := &e.frames[len(e.frames)-1]
+		arg, ok, err := top.next()
+		if err != nil {
+			top.close()
+			e.frames = e.frames[:len(e.frames)-1]
+			return "", err
+		}
 		if !ok {
-			if expanded != nil {
-				expanded = append(expanded, s)
-			}
+			top.close()
+			e.frames = e.frames[:len(e.frames)-1]
 			continue
 		}
-		if expanded == nil {
-			expanded = make([]string, 0, len(args)*2)
-			expanded = append(expanded, args[:i]...)
+
+		rawPath, ok := strings.CutPrefix(arg, "@")
+		if !ok {
+			return arg, nil
 		}
-		buf, err := os.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("cannot read response file: %w", err)
-		}
-		// Parsing the entire file as a string is perhaps unnecessary,
-		// but it simplifies the code and may result in fewer allocs.
-		rest := string(buf)
-		for len(rest) > 0 {
-			var line string
-			line, rest, _ = strings.Cut(rest, "\n")
-			// TODO: errors should include filename and ideally position.
-			// TODO: should we trim all surrounding spaces?
-			// TODO: should we skip empty lines?
-			line = strings.TrimSuffix(line, "\r") // support CRLF
-			arg, err := decodeArg(line)
-			if err != nil {
-				return nil, err
+		// len(e.frames) includes the synthetic top-level frame for the
+		// original args, so subtract it to count nested response files only.
+		if len(e.frames)-1 >= e.opts.MaxDepth {
+			return "", fmt.Errorf("responsefile: nesting depth %d exceeded", e.opts.MaxDepth)
+		}
+
+		// Resolve to an absolute path so that the same file referenced via
+		// different relative paths is still recognized as a cycle.
+		// fs.FS paths have no such notion, so they are used as-is.
+		path := rawPath
+		if e.opts.FS == nil {
+			if abs, err := filepath.Abs(rawPath); err == nil {
+				path = abs
 			}
-			if strings.HasPrefix(arg, "@") {
-				// Nested response files, which should be rare.
-				nested, err := Expand([]string{arg}, opts)
-				if err != nil {
-					return nil, err
-				}
-				expanded = append(expanded, nested...)
-			} else {
-				expanded = append(expanded, arg)
+		}
+		if i := slices.IndexFunc(e.frames, func(f expanderFrame) bool { return f.path == path }); i >= 0 {
+			chain := make([]string, 0, len(e.frames)-i+1)
+			for _, f := range e.frames[i:] {
+				chain = append(chain, f.path)
 			}
+			chain = append(chain, path)
+			return "", fmt.Errorf("responsefile: cycle detected: %s", strings.Join(chain, " -> "))
 		}
+
+		var r io.ReadCloser
+		if e.opts.FS != nil {
+			r, err = e.opts.FS.Open(path)
+		} else {
+			r, err = os.Open(path)
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot read response file: %w", err)
+		}
+		e.frames = append(e.frames, expanderFrame{
+			path:   path,
+			tok:    newFileTokenizer(r, e.opts.Dialect),
+			closer: r,
+		})
 	}
-	// Avoid making a copy of the slice when there are no response files.
-	if expanded == nil {
-		return args, nil
+	return "", io.EOF
+}
+
+// fileTokenizer reads the arguments of a response file one at a time from
+// r, according to dialect, without ever holding the whole file in memory.
+type fileTokenizer struct {
+	r       *bufio.Reader
+	dialect Dialect
+	off     int // bytes consumed so far, for error messages
+}
+
+// newFileTokenizer creates a [fileTokenizer] reading from r.
+func newFileTokenizer(r io.Reader, dialect Dialect) *fileTokenizer {
+	return &fileTokenizer{r: bufio.NewReader(r), dialect: dialect}
+}
+
+// next returns the next argument, or [io.EOF] once r is
+// exhausted.
+func (t *fileTokenizer) next() (string, error) {
+	switch t.dialect {
+	case DialectGCC, DialectMSVC:
+		return t.nextQuoted()
+	default:
+		return t.nextDefault()
 	}
-	return expanded, nil
 }
 
-func decodeArg(line string) (string, error) {
+// readByte reads a single byte, tracking t.off for error messages.
+func (t *fileTokenizer) readByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.off++
+	}
+	return b, err
+}
+
+// nextDefault reads one line as a single argument, as used by
+// [DialectDefault].
+func (t *fileTokenizer) nextDefault() (string, error) {
+	line, err := t.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	atEOF := err == io.EOF
+	lineStart := t.off
+	t.off += len(line)
+	if atEOF && line == "" {
+		return "", io.EOF
+	}
+	// TODO: should we trim all surrounding spaces?
+	// TODO: should we skip empty lines?
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r") // support CRLF
+	arg, err := decodeArgDefault(line)
+	if err != nil {
+		return "", fmt.Errorf("at byte offset %d: %w", lineStart, err)
+	}
+	return arg, nil
+}
+
+func decodeArgDefault(line string) (string, error) {
 	if !strings.Contains(line, "\\") {
 		return line, nil // shortcut
 	}
@@ -206,3 +502,90 @@ func decodeArg(line string) (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// isSpace reports whether b is whitespace under [DialectGCC] or [DialectMSVC].
+func isSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
+
+// nextQuoted reads the next whitespace-separated argument, honoring
+// double-quoted strings as used by [DialectGCC] and [DialectMSVC], and `#`
+// comments as used by [DialectGCC] only.
+func (t *fileTokenizer) nextQuoted() (string, error) {
+	// Skip whitespace and comments between arguments.
+	for {
+		b, err := t.readByte()
+		if err == io.EOF {
+			return "", io.EOF
+		}
+		if err != nil {
+			return "", err
+		}
+		if isSpace(b) {
+			continue
+		}
+		if t.dialect == DialectGCC && b == '#' {
+			for {
+				b, err := t.readByte()
+				if err == io.EOF {
+					return "", io.EOF
+				}
+				if err != nil {
+					return "", err
+				}
+				if b == '\n' {
+					break
+				}
+			}
+			continue
+		}
+		if err := t.r.UnreadByte(); err != nil {
+			return "", err
+		}
+		t.off--
+		break
+	}
+
+	start := t.off
+	var buf strings.Builder
+	inQuotes := false
+	for {
+		b, err := t.readByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !inQuotes && isSpace(b) {
+			break
+		}
+		if b == '"' {
+			if t.dialect == DialectMSVC && inQuotes {
+				if next, err := t.r.Peek(1); err == nil && next[0] == '"' {
+					buf.WriteByte('"')
+					t.readByte()
+					continue
+				}
+			}
+			inQuotes = !inQuotes
+			continue
+		}
+		if b == '\\' && inQuotes {
+			if next, err := t.r.Peek(1); err == nil && (next[0] == '"' || next[0] == '\\') {
+				buf.WriteByte(next[0])
+				t.readByte()
+				continue
+			}
+		}
+		buf.WriteByte(b)
+	}
+	if inQuotes {
+		return "", fmt.Errorf("at byte offset %d: unterminated quoted string", start)
+	}
+	return buf.String(), nil
+}
@@ -4,9 +4,14 @@
 package responsefile_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"slices"
 	"testing"
+	"testing/fstest"
 
 	"mvdan.cc/responsefile"
 )
@@ -104,6 +109,47 @@ func TestShorten(t *testing.T) {
 	}
 }
 
+func TestExec(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		shortenOptions responsefile.ShortenOptions
+		args           []string
+
+		wantResponseFile bool
+	}{
+		{
+			shortenOptions:   responsefile.ShortenOptions{},
+			args:             []string{"foo", "bar", "baz"},
+			wantResponseFile: false,
+		},
+		{
+			shortenOptions: responsefile.ShortenOptions{
+				ArgLengthLimit: -1,
+			},
+			args:             []string{"foo", "bar", "baz"},
+			wantResponseFile: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			cmd, cleanup, err := responsefile.Exec(context.Background(), "some-tool", test.args, test.shortenOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(cleanup)
+
+			gotResponseFile := !slices.Equal(cmd.Args[1:], test.args)
+			if gotResponseFile != test.wantResponseFile {
+				t.Fatalf("got args %#v, wantResponseFile=%v", cmd.Args, test.wantResponseFile)
+			}
+		})
+	}
+}
+
 func TestExpand(t *testing.T) {
 	t.Parallel()
 
@@ -124,9 +170,34 @@ func TestExpand(t *testing.T) {
 		return "@" + f.Name()
 	}
 
+	// twoFileCycle creates two response files which reference one another,
+	// and returns an argument pointing at the first.
+	twoFileCycle := func() string {
+		t.Helper()
+		f1, err := os.CreateTemp(tdir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f1.Close()
+		f2, err := os.CreateTemp(tdir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2.Close()
+		if err := os.WriteFile(f1.Name(), []byte("@"+f2.Name()+"\n"), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f2.Name(), []byte("@"+f1.Name()+"\n"), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		return "@" + f1.Name()
+	}
+
 	tests := []struct {
+		opts     responsefile.ExpandOptions
 		args     []string
 		wantArgs []string
+		wantErr  bool
 	}{
 		{
 			args:     []string{},
@@ -153,6 +224,26 @@ func TestExpand(t *testing.T) {
 			},
 			wantArgs: []string{"l1_1", "l2_1", "l2_2", "l3", "l2_3", "l2_4", "l1_2"},
 		},
+		{
+			// Two response files referencing one another must be rejected
+			// rather than recursing forever.
+			args:    []string{twoFileCycle()},
+			wantErr: true,
+		},
+		{
+			// A chain nested deeper than MaxDepth must be rejected.
+			opts:    responsefile.ExpandOptions{MaxDepth: 2},
+			args:    []string{atTemp(atTemp(atTemp("too deep")))},
+			wantErr: true,
+		},
+		{
+			// MaxDepth counts nested response files only, not the
+			// top-level args, so a chain exactly as deep as MaxDepth
+			// must still succeed.
+			opts:     responsefile.ExpandOptions{MaxDepth: 3},
+			args:     []string{atTemp(atTemp(atTemp("just deep enough")))},
+			wantArgs: []string{"just deep enough"},
+		},
 	}
 
 	for _, test := range tests {
@@ -160,7 +251,13 @@ func TestExpand(t *testing.T) {
 		t.Run("", func(t *testing.T) {
 			t.Parallel()
 
-			expanded, err := responsefile.Expand(test.args, responsefile.ExpandOptions{})
+			expanded, err := responsefile.Expand(test.args, test.opts)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", expanded)
+				}
+				return
+			}
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -170,3 +267,203 @@ func TestExpand(t *testing.T) {
 		})
 	}
 }
+
+func TestExpandDialect(t *testing.T) {
+	t.Parallel()
+
+	tdir := t.TempDir()
+	atTemp := func(content string) (path string) {
+		t.Helper()
+		f, err := os.CreateTemp(tdir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return "@" + f.Name()
+	}
+
+	tests := []struct {
+		dialect  responsefile.Dialect
+		content  string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			dialect:  responsefile.DialectGCC,
+			content:  "foo bar baz",
+			wantArgs: []string{"foo", "bar", "baz"},
+		},
+		{
+			dialect:  responsefile.DialectGCC,
+			content:  "foo \"bar baz\" qux\n# a comment\nquux",
+			wantArgs: []string{"foo", "bar baz", "qux", "quux"},
+		},
+		{
+			dialect:  responsefile.DialectGCC,
+			content:  `"a \"quoted\" value" plain\backslash`,
+			wantArgs: []string{`a "quoted" value`, `plain\backslash`},
+		},
+		{
+			dialect: responsefile.DialectGCC,
+			content: `"unterminated`,
+			wantErr: true,
+		},
+		{
+			dialect:  responsefile.DialectMSVC,
+			content:  `"a ""quoted"" value" foo`,
+			wantArgs: []string{`a "quoted" value`, "foo"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			expanded, err := responsefile.Expand([]string{atTemp(test.content)}, responsefile.ExpandOptions{Dialect: test.dialect})
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(expanded, test.wantArgs) {
+				t.Fatalf("expand got %#v, expected %#v", expanded, test.wantArgs)
+			}
+		})
+	}
+}
+
+// TestRoundtripDialect ensures that [Shorten] and [Expand] agree with one
+// another for each dialect, so that an argument encoded under a dialect is
+// always parsed back unchanged under that same dialect.
+func TestRoundtripDialect(t *testing.T) {
+	t.Parallel()
+
+	dialects := []responsefile.Dialect{responsefile.DialectGCC, responsefile.DialectMSVC}
+	args := []string{"foo", "bar baz", `quoted "arg"`, `back\slash`, "#comment-like", ""}
+
+	for _, dialect := range dialects {
+		dialect := dialect
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			shortened, cleanup, err := responsefile.Shorten(args, responsefile.ShortenOptions{
+				ArgLengthLimit: -1,
+				Dialect:        dialect,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(cleanup)
+
+			expanded, err := responsefile.Expand(shortened, responsefile.ExpandOptions{Dialect: dialect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(expanded, args) {
+				t.Fatalf("roundtrip got %#v, expected %#v", expanded, args)
+			}
+		})
+	}
+}
+
+// memWriteCloser is an [io.WriteCloser] which saves its contents into an
+// in-memory file store on Close, for use with [responsefile.ShortenOptions.CreateFile].
+type memWriteCloser struct {
+	buf   bytes.Buffer
+	name  string
+	store map[string][]byte
+}
+
+func (w *memWriteCloser) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriteCloser) Close() error {
+	w.store[w.name] = w.buf.Bytes()
+	return nil
+}
+
+// TestRoundtripInMemory exercises [responsefile.ShortenOptions.CreateFile]
+// and [responsefile.ExpandOptions.FS] together, performing a roundtrip
+// with the response file written and read only in memory. The cleanup func
+// from Shorten still calls os.Remove on the in-memory file's name.
+func TestRoundtripInMemory(t *testing.T) {
+	t.Parallel()
+
+	store := make(map[string][]byte)
+	var count int
+	createFile := func(dir, pattern string) (io.WriteCloser, string, error) {
+		count++
+		name := fmt.Sprintf("%s-%d", pattern, count)
+		return &memWriteCloser{name: name, store: store}, name, nil
+	}
+
+	args := []string{"foo", "bar", "baz"}
+	shortened, cleanup, err := responsefile.Shorten(args, responsefile.ShortenOptions{
+		ArgLengthLimit: -1,
+		CreateFile:     createFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	if slices.Equal(shortened, args) {
+		t.Fatalf("expected a response file, got %#v", shortened)
+	}
+
+	mapFS := make(fstest.MapFS, len(store))
+	for name, data := range store {
+		mapFS[name] = &fstest.MapFile{Data: data}
+	}
+
+	expanded, err := responsefile.Expand(shortened, responsefile.ExpandOptions{FS: mapFS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expanded, args) {
+		t.Fatalf("roundtrip got %#v, expected %#v", expanded, args)
+	}
+}
+
+func TestExpander(t *testing.T) {
+	t.Parallel()
+
+	tdir := t.TempDir()
+	atTemp := func(content string) (path string) {
+		t.Helper()
+		f, err := os.CreateTemp(tdir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return "@" + f.Name()
+	}
+
+	args := []string{"foo", atTemp("bar1\nbar2\n"), "baz"}
+	want := []string{"foo", "bar1", "bar2", "baz"}
+
+	exp := responsefile.NewExpander(args, responsefile.ExpandOptions{})
+	var got []string
+	for {
+		arg, err := exp.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, arg)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %#v, expected %#v", got, want)
+	}
+}